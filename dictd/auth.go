@@ -0,0 +1,158 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* auth.go - RFC 2229 AUTH support.
+ *
+ * AUTH is an APOP-style exchange: the client hashes the session's
+ * MsgId banner together with a shared secret it already knows, and
+ * sends the digest along; the server does the same computation against
+ * whatever secret it has on file for that user and compares. Nothing
+ * secret ever goes over the wire, which is the whole point of doing it
+ * this way on an unencrypted port. */
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"strings"
+)
+
+/* Authenticator looks up the shared secret for a user. A non-nil err
+ * (e.g. for an unknown user) makes AUTH fail with the same 531 reply
+ * as a wrong digest, so the reply doesn't leak whether the user
+ * exists. */
+type Authenticator interface {
+	Lookup(user string) (secret string, err error)
+}
+
+/* AuthMode selects how the AUTH command verifies a client's
+ * credentials. */
+type AuthMode int
+
+const (
+	/* AuthDigest is the RFC 2229 APOP-style md5(MsgId + secret) scheme. */
+	AuthDigest AuthMode = iota
+	/* AuthPlain accepts the shared secret in the clear. It's only safe
+	 * once STARTTLS (or an implicit-TLS listener) has wrapped the
+	 * connection, which is why it's opt-in via Server.AuthMode. */
+	AuthPlain
+)
+
+/* digest computes the APOP-style md5(msgId + secret) hex digest that
+ * AUTH compares against. */
+func digest(msgId, secret string) string {
+	sum := md5.Sum([]byte(msgId + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+/* authHandler implements the AUTH command: `AUTH user digest-or-secret`. */
+func authHandler(session *Session, command Command) {
+	if len(command.Params) < 2 {
+		WriteCode(session, 501, "Syntax error, illegal parameters")
+		return
+	}
+
+	server := session.DictServer
+	if server.Authenticator == nil {
+		WriteCode(session, 530, "Access denied (authentication not configured)")
+		return
+	}
+
+	user := command.Params[0]
+	supplied := command.Params[1]
+
+	secret, err := server.Authenticator.Lookup(user)
+	if err != nil {
+		WriteCode(session, 531, "Access denied")
+		return
+	}
+
+	var want string
+	switch server.AuthMode {
+	case AuthPlain:
+		if _, isTLS := session.Conn.(*tls.Conn); !isTLS {
+			/* AUTH PLAIN hands the secret over in the clear; refuse it
+			 * outright unless the connection is actually TLS-backed
+			 * (implicit TLS, or after a successful STARTTLS), regardless
+			 * of what Server.AuthMode says. */
+			WriteCode(session, 530, "Access denied (AUTH PLAIN requires a TLS connection)")
+			return
+		}
+		want = secret
+	default:
+		want = digest(session.MsgId, secret)
+	}
+
+	if !hmac.Equal([]byte(want), []byte(supplied)) {
+		WriteCode(session, 531, "Access denied")
+		return
+	}
+
+	session.Client = user
+	session.Authenticated = true
+	WriteCode(session, 230, "Authentication successful")
+}
+
+/* requireAuth reports whether access to the named database should be
+ * gated behind a successful AUTH. Servers mark a database "restricted"
+ * by listing it in Server.RestrictedDatabases; anything not in that set
+ * is open to anonymous clients. */
+func requireAuth(server *Server, database string) bool {
+	return server.RestrictedDatabases != nil && server.RestrictedDatabases[database]
+}
+
+/* restrictedDatabaseParam extracts the database name a command is
+ * about to touch, for the handful of commands that take one: DEFINE,
+ * MATCH, and SHOW INFO. Anything else (SHOW DB, CLIENT, AUTH, ...)
+ * doesn't target a specific database and is never gated. */
+func restrictedDatabaseParam(command *Command) (database string, ok bool) {
+	switch command.Command {
+	case "DEFINE", "MATCH":
+		if len(command.Params) > 0 {
+			return command.Params[0], true
+		}
+	case "SHOW":
+		if len(command.Params) > 1 && strings.ToUpper(command.Params[0]) == "INFO" {
+			return command.Params[1], true
+		}
+	}
+	return "", false
+}
+
+/* authorizeCommand enforces Server.RestrictedDatabases before a
+ * command reaches its handler: if command targets a restricted
+ * database and session hasn't AUTHed, it writes the RFC 2229 "access
+ * denied" response itself and reports false so handleCommand skips the
+ * handler. */
+func authorizeCommand(session *Session, command *Command) bool {
+	database, ok := restrictedDatabaseParam(command)
+	if !ok || session.Authenticated {
+		return true
+	}
+	if !requireAuth(session.DictServer, database) {
+		return true
+	}
+	WriteCode(session, 530, "Access denied (AUTH required for database "+database+")")
+	return false
+}
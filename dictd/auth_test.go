@@ -0,0 +1,322 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+/* discardTransport is a no-op Transport, for tests that only care
+ * whether a response was written, not what it says. */
+type discardTransport struct{}
+
+func (*discardTransport) ReadLine() (string, error)                           { return "", io.EOF }
+func (*discardTransport) PrintfLine(format string, args ...interface{}) error { return nil }
+func (*discardTransport) DotWriter() io.WriteCloser                           { return nil }
+func (*discardTransport) Close() error                                        { return nil }
+
+func TestDigest(t *testing.T) {
+	msgId := "<123.456@dictd.example.org>"
+	secret := "hunter2"
+
+	sum := md5.Sum([]byte(msgId + secret))
+	want := hex.EncodeToString(sum[:])
+
+	if got := digest(msgId, secret); got != want {
+		t.Errorf("digest(%q, %q) = %q, want %q", msgId, secret, got, want)
+	}
+}
+
+func TestDigestDiffersOnMsgId(t *testing.T) {
+	secret := "hunter2"
+	a := digest("<1@test>", secret)
+	b := digest("<2@test>", secret)
+	if a == b {
+		t.Errorf("digest produced the same value for two different msg-ids")
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	server := &Server{
+		RestrictedDatabases: map[string]bool{"premium": true},
+	}
+
+	if requireAuth(server, "premium") != true {
+		t.Errorf("requireAuth(premium) = false, want true")
+	}
+	if requireAuth(server, "wn") != false {
+		t.Errorf("requireAuth(wn) = true, want false")
+	}
+
+	var unrestricted Server
+	if requireAuth(&unrestricted, "wn") != false {
+		t.Errorf("requireAuth against a server with no RestrictedDatabases = true, want false")
+	}
+}
+
+func TestRestrictedDatabaseParam(t *testing.T) {
+	cases := []struct {
+		name    string
+		command Command
+		wantDB  string
+		wantOk  bool
+	}{
+		{name: "DEFINE", command: Command{Command: "DEFINE", Params: []string{"wn", "hello"}}, wantDB: "wn", wantOk: true},
+		{name: "MATCH", command: Command{Command: "MATCH", Params: []string{"wn", "exact", "hello"}}, wantDB: "wn", wantOk: true},
+		{name: "SHOW INFO", command: Command{Command: "SHOW", Params: []string{"INFO", "wn"}}, wantDB: "wn", wantOk: true},
+		{name: "SHOW DB", command: Command{Command: "SHOW", Params: []string{"DB"}}, wantDB: "", wantOk: false},
+		{name: "CLIENT", command: Command{Command: "CLIENT", Params: []string{"foo"}}, wantDB: "", wantOk: false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, ok := restrictedDatabaseParam(&tc.command)
+			if db != tc.wantDB || ok != tc.wantOk {
+				t.Errorf("restrictedDatabaseParam(%+v) = (%q, %v), want (%q, %v)",
+					tc.command, db, ok, tc.wantDB, tc.wantOk)
+			}
+		})
+	}
+}
+
+/* stubDatabase is a minimal Database for tests that only care about
+ * which databases candidateDatabases selects, not their contents. */
+type stubDatabase struct{ name string }
+
+func (d stubDatabase) Name() string                                           { return d.name }
+func (d stubDatabase) Description() string                                    { return d.name }
+func (d stubDatabase) Define(ctx context.Context, word string) (string, bool) { return "", false }
+func (d stubDatabase) Match(ctx context.Context, strategy, word string) []string {
+	return nil
+}
+
+func TestCandidateDatabasesWildcardSkipsRestricted(t *testing.T) {
+	server := &Server{
+		Databases: map[string]Database{
+			"wn":      stubDatabase{"wn"},
+			"premium": stubDatabase{"premium"},
+		},
+		RestrictedDatabases: map[string]bool{"premium": true},
+	}
+
+	anon, err := candidateDatabases(server, "*", false)
+	if err != nil {
+		t.Fatalf("candidateDatabases(*, anonymous) error: %v", err)
+	}
+	if len(anon) != 1 || anon[0].Name() != "wn" {
+		t.Errorf("candidateDatabases(*, anonymous) = %v, want just [wn]", anon)
+	}
+
+	auth, err := candidateDatabases(server, "*", true)
+	if err != nil {
+		t.Fatalf("candidateDatabases(*, authenticated) error: %v", err)
+	}
+	if len(auth) != 2 {
+		t.Errorf("candidateDatabases(*, authenticated) = %v, want both databases", auth)
+	}
+}
+
+func TestAuthorizeCommand(t *testing.T) {
+	server := &Server{
+		RestrictedDatabases: map[string]bool{"premium": true},
+	}
+
+	cases := []struct {
+		name          string
+		authenticated bool
+		command       Command
+		want          bool
+	}{
+		{name: "unrestricted db, anonymous", command: Command{Command: "DEFINE", Params: []string{"wn", "hello"}}, want: true},
+		{name: "restricted db, anonymous", command: Command{Command: "DEFINE", Params: []string{"premium", "hello"}}, want: false},
+		{name: "restricted db, authenticated", authenticated: true, command: Command{Command: "DEFINE", Params: []string{"premium", "hello"}}, want: true},
+		{name: "not a database command", command: Command{Command: "CLIENT", Params: []string{"foo"}}, want: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			session := &Session{
+				DictServer:    server,
+				Authenticated: tc.authenticated,
+				Connection:    &discardTransport{},
+			}
+			if got := authorizeCommand(session, &tc.command); got != tc.want {
+				t.Errorf("authorizeCommand(%+v) = %v, want %v", tc.command, got, tc.want)
+			}
+		})
+	}
+}
+
+/* mapAuthenticator is a minimal Authenticator backed by a map, for
+ * tests that only care about AUTH's own logic. */
+type mapAuthenticator map[string]string
+
+var errNoSuchUser = errors.New("dictd: no such user")
+
+func (m mapAuthenticator) Lookup(user string) (string, error) {
+	secret, ok := m[user]
+	if !ok {
+		return "", errNoSuchUser
+	}
+	return secret, nil
+}
+
+/* startAuthServer starts server listening on loopback and returns a
+ * dialed Client with the banner already read, so tests can drive AUTH
+ * through the same Client the rest of the package tests use. */
+func startAuthServer(t *testing.T, server *Server) *Client {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go serve(context.Background(), server, listener)
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+/* TestAuthHandlerDigest drives AUTH's default APOP-style digest mode
+ * end to end against a live Server: a correct digest succeeds, a wrong
+ * one is rejected, and an unconfigured Authenticator fails outright. */
+func TestAuthHandlerDigest(t *testing.T) {
+	t.Run("correct digest succeeds", func(t *testing.T) {
+		server := NewServer("test")
+		server.Authenticator = mapAuthenticator{"alice": "hunter2"}
+		client := startAuthServer(t, server)
+
+		if err := client.Auth("alice", digest(client.MsgId(), "hunter2")); err != nil {
+			t.Errorf("Auth with correct digest: %v", err)
+		}
+	})
+
+	t.Run("wrong digest is rejected", func(t *testing.T) {
+		server := NewServer("test")
+		server.Authenticator = mapAuthenticator{"alice": "hunter2"}
+		client := startAuthServer(t, server)
+
+		err := client.Auth("alice", digest(client.MsgId(), "wrong"))
+		dictErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Auth err = %v (%T), want *Error", err, err)
+		}
+		if dictErr.Code != 531 {
+			t.Errorf("Auth err code = %d, want 531", dictErr.Code)
+		}
+	})
+
+	t.Run("unknown user is rejected", func(t *testing.T) {
+		server := NewServer("test")
+		server.Authenticator = mapAuthenticator{"alice": "hunter2"}
+		client := startAuthServer(t, server)
+
+		err := client.Auth("mallory", digest(client.MsgId(), "whatever"))
+		dictErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Auth err = %v (%T), want *Error", err, err)
+		}
+		if dictErr.Code != 531 {
+			t.Errorf("Auth err code = %d, want 531", dictErr.Code)
+		}
+	})
+
+	t.Run("no Authenticator configured", func(t *testing.T) {
+		server := NewServer("test")
+		client := startAuthServer(t, server)
+
+		err := client.Auth("alice", digest(client.MsgId(), "hunter2"))
+		dictErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Auth err = %v (%T), want *Error", err, err)
+		}
+		if dictErr.Code != 530 {
+			t.Errorf("Auth err code = %d, want 530", dictErr.Code)
+		}
+	})
+}
+
+/* TestAuthHandlerPlain drives AUTH PLAIN: refused outright over a plain
+ * connection regardless of whether the secret is right, and accepted
+ * over TLS. */
+func TestAuthHandlerPlain(t *testing.T) {
+	t.Run("refused over a plain connection", func(t *testing.T) {
+		server := NewServer("test")
+		server.AuthMode = AuthPlain
+		server.Authenticator = mapAuthenticator{"alice": "hunter2"}
+		client := startAuthServer(t, server)
+
+		err := client.Auth("alice", "hunter2")
+		dictErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("Auth err = %v (%T), want *Error", err, err)
+		}
+		if dictErr.Code != 530 {
+			t.Errorf("Auth err code = %d, want 530 (PLAIN requires TLS)", dictErr.Code)
+		}
+	})
+
+	t.Run("accepted over TLS", func(t *testing.T) {
+		server := NewServer("test")
+		server.AuthMode = AuthPlain
+		server.Authenticator = mapAuthenticator{"alice": "hunter2"}
+		server.TLSConfig = selfSignedTLSConfig(t)
+
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", server.TLSConfig)
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		defer listener.Close()
+		go serve(context.Background(), server, listener)
+
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("tls dial: %v", err)
+		}
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		if _, err := text.ReadLine(); err != nil {
+			t.Fatalf("read banner: %v", err)
+		}
+		if err := text.PrintfLine("AUTH alice hunter2"); err != nil {
+			t.Fatalf("send AUTH: %v", err)
+		}
+		if line, err := text.ReadLine(); err != nil || line != "230 Authentication successful" {
+			t.Fatalf("AUTH reply = %q, %v; want 230", line, err)
+		}
+	})
+}
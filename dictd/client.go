@@ -0,0 +1,361 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* client.go - RFC 2229 client, for folks who want to talk *to* a dict
+ * server rather than run one. Built on net/textproto, and reusing the
+ * same tokenizeLine helper the server side uses, to pick apart
+ * response headers. */
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+/* ClientDefinition is a single DEFINE result: the word as found in
+ * `Database`, plus the body of the entry. Named ClientDefinition
+ * rather than Definition to avoid colliding with the server-side
+ * Definition type. */
+type ClientDefinition struct {
+	Word     string
+	Database string
+	Name     string
+	Text     string
+}
+
+/* Match is a single MATCH result. */
+type Match struct {
+	Database string
+	Word     string
+}
+
+/* RemoteDatabase describes one entry from SHOW DATABASES. Named
+ * RemoteDatabase rather than Database to avoid colliding with the
+ * server-side Database interface. */
+type RemoteDatabase struct {
+	Name        string
+	Description string
+}
+
+/* Strategy describes one entry from SHOW STRATEGIES. */
+type Strategy struct {
+	Name        string
+	Description string
+}
+
+/* Error is a typed error carrying the RFC 2229 status code that the
+ * server sent back, so callers can branch on it (550 invalid database,
+ * 552 no match, and so on) instead of string-matching. */
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("dictd: %d %s", err.Code, err.Message)
+}
+
+/* Client is a connection to a remote RFC 2229 dict server. It mirrors
+ * the shape of the old net/dict example client: Dial it, call methods,
+ * Close it when done. */
+type Client struct {
+	text *textproto.Conn
+
+	/* Banner is the full text of the server's 220 greeting, as sent. */
+	Banner string
+}
+
+/* Dial connects to a dict server at addr (over `network`, almost always
+ * "tcp"), reads the 220 banner, and returns a ready-to-use Client. The
+ * banner is kept on Client.Banner (see Client.MsgId), since AUTH needs
+ * the message-id the server handed out in it. */
+func Dial(network, addr string) (*Client, error) {
+	text, err := textproto.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{text: text}
+	_, banner, err := client.text.ReadCodeLine(220)
+	if err != nil {
+		client.text.Close()
+		return nil, err
+	}
+	client.Banner = banner
+
+	return client, nil
+}
+
+/* MsgId returns the message-id token from the server's banner (the
+ * last whitespace-separated field, conventionally angle-bracketed,
+ * e.g. "<123.456@dictd.example.org>"), or "" if the banner didn't carry
+ * one. This is the value AUTH's digest is computed over: see Auth. */
+func (client *Client) MsgId() string {
+	fields := strings.Fields(client.Banner)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+/* Close closes the underlying connection. */
+func (client *Client) Close() error {
+	return client.text.Close()
+}
+
+/* cmd sends a command line and waits for a response whose status code
+ * is `expectCode`, returning the message text of that response line. */
+func (client *Client) cmd(expectCode int, format string, args ...interface{}) (string, error) {
+	id, err := client.text.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+
+	client.text.StartResponse(id)
+	defer client.text.EndResponse(id)
+
+	code, message, err := client.text.ReadCodeLine(-1)
+	if err != nil {
+		return "", err
+	}
+	if code != expectCode {
+		return "", &Error{Code: code, Message: message}
+	}
+	return message, nil
+}
+
+/* readTextBlock reads an RFC 2229 "text block": a dot-terminated,
+ * dot-stuffed run of lines as used for definitions, info text, and the
+ * like. */
+func (client *Client) readTextBlock() (string, error) {
+	lines, err := client.text.ReadDotLines()
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+/* Define runs `DEFINE database word` and returns every definition the
+ * server sent back. database may be "*" (all databases) or "!" (first
+ * match), per RFC 2229. */
+func (client *Client) Define(database, word string) ([]ClientDefinition, error) {
+	message, err := client.cmd(150, "DEFINE %s %s", database, word)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := tokenizeLine(message)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := make([]ClientDefinition, 0, n)
+	for i := 0; i < n; i++ {
+		_, headerMsg, err := client.text.ReadCodeLine(151)
+		if err != nil {
+			return nil, err
+		}
+		headerTokens, err := tokenizeLine(headerMsg)
+		if err != nil {
+			return nil, err
+		}
+		if len(headerTokens) < 3 {
+			return nil, &Error{Code: 151, Message: "malformed 151 header: " + headerMsg}
+		}
+
+		text, err := client.readTextBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		definitions = append(definitions, ClientDefinition{
+			Word:     headerTokens[0],
+			Database: headerTokens[1],
+			Name:     headerTokens[2],
+			Text:     text,
+		})
+	}
+
+	if _, _, err := client.text.ReadCodeLine(250); err != nil {
+		return nil, err
+	}
+	return definitions, nil
+}
+
+/* Match runs `MATCH database strategy word` and returns the list of
+ * matches the server found. */
+func (client *Client) Match(database, strategy, word string) ([]Match, error) {
+	message, err := client.cmd(152, "MATCH %s %s %s", database, strategy, word)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := tokenizeLine(message)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		return nil, err
+	}
+
+	lines, err := client.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]Match, 0, n)
+	for _, line := range lines {
+		pair, err := tokenizeLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(pair) < 2 {
+			continue
+		}
+		matches = append(matches, Match{Database: pair[0], Word: pair[1]})
+	}
+
+	if _, _, err := client.text.ReadCodeLine(250); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+/* ShowDatabases runs `SHOW DB` and returns the databases the server
+ * advertises. */
+func (client *Client) ShowDatabases() ([]RemoteDatabase, error) {
+	if _, err := client.cmd(110, "SHOW DB"); err != nil {
+		return nil, err
+	}
+
+	lines, err := client.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	databases := make([]RemoteDatabase, 0, len(lines))
+	for _, line := range lines {
+		pair, err := tokenizeLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(pair) < 2 {
+			continue
+		}
+		databases = append(databases, RemoteDatabase{Name: pair[0], Description: pair[1]})
+	}
+
+	if _, _, err := client.text.ReadCodeLine(250); err != nil {
+		return nil, err
+	}
+	return databases, nil
+}
+
+/* ShowStrategies runs `SHOW STRAT` and returns the matching strategies
+ * the server supports. */
+func (client *Client) ShowStrategies() ([]Strategy, error) {
+	if _, err := client.cmd(111, "SHOW STRAT"); err != nil {
+		return nil, err
+	}
+
+	lines, err := client.text.ReadDotLines()
+	if err != nil {
+		return nil, err
+	}
+
+	strategies := make([]Strategy, 0, len(lines))
+	for _, line := range lines {
+		pair, err := tokenizeLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if len(pair) < 2 {
+			continue
+		}
+		strategies = append(strategies, Strategy{Name: pair[0], Description: pair[1]})
+	}
+
+	if _, _, err := client.text.ReadCodeLine(250); err != nil {
+		return nil, err
+	}
+	return strategies, nil
+}
+
+/* ShowInfo runs `SHOW INFO database` and returns the free-text
+ * description of that database. */
+func (client *Client) ShowInfo(database string) (string, error) {
+	if _, err := client.cmd(112, "SHOW INFO %s", database); err != nil {
+		return "", err
+	}
+
+	text, err := client.readTextBlock()
+	if err != nil {
+		return "", err
+	}
+
+	if _, _, err := client.text.ReadCodeLine(250); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+/* ClientName sends `CLIENT name`, identifying this client to the
+ * server (named ClientName to avoid colliding with the Client type
+ * itself). */
+func (client *Client) ClientName(name string) error {
+	_, err := client.cmd(250, "CLIENT %s", name)
+	return err
+}
+
+/* OptionMime turns on MIME headers for the definitions the server sends
+ * back, via `OPTION MIME`. It has no way to turn them off again. */
+func (client *Client) OptionMime() error {
+	_, err := client.cmd(250, "OPTION MIME")
+	return err
+}
+
+/* Auth performs the RFC 2229 APOP-style AUTH exchange: `AUTH user
+ * digest`, where digest is supplied by the caller (typically computed
+ * from the server's banner MsgId and a shared secret; see the
+ * Authenticator-side helpers in auth.go for the matching server
+ * implementation). */
+func (client *Client) Auth(user, digest string) error {
+	_, err := client.cmd(230, "AUTH %s %s", user, digest)
+	return err
+}
+
+/* Quit sends QUIT and closes the connection. */
+func (client *Client) Quit() error {
+	_, err := client.cmd(221, "QUIT")
+	closeErr := client.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
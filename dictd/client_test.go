@@ -0,0 +1,163 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+import (
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+/* dialFakeServer listens on loopback, hands the accepted connection to
+ * serve (which plays the server side of the protocol by hand), and
+ * returns a Client already Dialed against it. serve's return value is
+ * delivered to errs so assertions made from its goroutine surface as a
+ * normal test failure. */
+func dialFakeServer(t *testing.T, banner string, serve func(conn *textproto.Conn) error) (*Client, chan error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		text := textproto.NewConn(conn)
+		defer text.Close()
+		if err := text.PrintfLine("220 %s", banner); err != nil {
+			errs <- err
+			return
+		}
+		errs <- serve(text)
+	}()
+
+	client, err := Dial("tcp", listener.Addr().String())
+	if err != nil {
+		listener.Close()
+		t.Fatalf("Dial: %v", err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		listener.Close()
+	})
+
+	return client, errs
+}
+
+func TestClientBanner(t *testing.T) {
+	client, errs := dialFakeServer(t, "test.example.org dictd banner <123.456@test>", func(conn *textproto.Conn) error {
+		return nil
+	})
+
+	if client.Banner != "test.example.org dictd banner <123.456@test>" {
+		t.Errorf("Banner = %q, want the raw greeting text", client.Banner)
+	}
+	if got, want := client.MsgId(), "<123.456@test>"; got != want {
+		t.Errorf("MsgId() = %q, want %q", got, want)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("server side: %v", err)
+	}
+}
+
+func TestClientDefine(t *testing.T) {
+	client, errs := dialFakeServer(t, "banner <1@test>", func(conn *textproto.Conn) error {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line != `DEFINE * hello` {
+			return &Error{Code: 500, Message: "unexpected command: " + line}
+		}
+
+		if err := conn.PrintfLine("150 1 definitions retrieved"); err != nil {
+			return err
+		}
+		if err := conn.PrintfLine(`151 hello wn "WordNet"`); err != nil {
+			return err
+		}
+		w := conn.DotWriter()
+		w.Write([]byte("a greeting\n"))
+		w.Close()
+		return conn.PrintfLine("250 ok")
+	})
+
+	defs, err := client.Define("*", "hello")
+	if err != nil {
+		t.Fatalf("Define: %v", err)
+	}
+	want := []ClientDefinition{{Word: "hello", Database: "wn", Name: "WordNet", Text: "a greeting"}}
+	if len(defs) != 1 || defs[0] != want[0] {
+		t.Errorf("Define = %+v, want %+v", defs, want)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("server side: %v", err)
+	}
+}
+
+func TestClientDefineError(t *testing.T) {
+	client, errs := dialFakeServer(t, "banner <1@test>", func(conn *textproto.Conn) error {
+		if _, err := conn.ReadLine(); err != nil {
+			return err
+		}
+		return conn.PrintfLine("552 no match")
+	})
+
+	_, err := client.Define("*", "zzyzzy")
+	dictErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Define err = %v (%T), want *Error", err, err)
+	}
+	if dictErr.Code != 552 {
+		t.Errorf("Define err code = %d, want 552", dictErr.Code)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("server side: %v", err)
+	}
+}
+
+func TestClientQuit(t *testing.T) {
+	client, errs := dialFakeServer(t, "banner <1@test>", func(conn *textproto.Conn) error {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return err
+		}
+		if line != "QUIT" {
+			return &Error{Code: 500, Message: "unexpected command: " + line}
+		}
+		return conn.PrintfLine("221 closing connection")
+	})
+
+	if err := client.Quit(); err != nil {
+		t.Fatalf("Quit: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("server side: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* commands.go - the handshake banner and the built-in RFC 2229 command
+ * handlers, registered on every Server by NewServer. */
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/* handshakeHandler sends the initial 220 banner: the server name, the
+ * capabilities it supports, and the session's message-id. Capabilities
+ * beyond "mime" (always advertised; see WriteTextBlock) are only
+ * listed when the server actually has them configured, e.g.
+ * "starttls" is omitted unless Server.TLSConfig is set (see
+ * tlsCapability). startTLSHandler re-calls this once a STARTTLS
+ * upgrade completes. */
+func handshakeHandler(session *Session) {
+	capabilities := []string{"mime"}
+	if cap := tlsCapability(session.DictServer); cap != "" {
+		capabilities = append(capabilities, cap)
+	}
+	WriteCode(session, 220, session.DictServer.Name+" dictd <"+strings.Join(capabilities, ".")+"> "+session.MsgId)
+}
+
+/* unknownCommandHandler is handleCommand's fallback for a command verb
+ * with no registered handler. */
+func unknownCommandHandler(session *Session, command Command) {
+	WriteCode(session, 500, "Syntax error, unknown command "+command.Command)
+}
+
+/* errUnknownDatabase is returned by candidateDatabases when command
+ * names a database that isn't in Server.Databases and isn't one of
+ * the "*"/"!" wildcards. */
+var errUnknownDatabase = errors.New("dictd: unknown database")
+
+/* candidateDatabases resolves a DEFINE/MATCH database argument to the
+ * Databases it should be tried against: every registered database the
+ * session is allowed to see, in name order, for "*" or "!"; the single
+ * named one otherwise. A wildcard silently skips databases gated by
+ * Server.RestrictedDatabases that the session hasn't AUTHed into (see
+ * requireAuth): authorizeCommand only checks the literal database
+ * argument handleCommand was dispatched with, so without this filter
+ * here a "*"/"!" wildcard would reach into a restricted database a
+ * session was never authorized for. */
+func candidateDatabases(server *Server, database string, authenticated bool) ([]Database, error) {
+	if database != "*" && database != "!" {
+		db, ok := server.Databases[database]
+		if !ok {
+			return nil, errUnknownDatabase
+		}
+		return []Database{db}, nil
+	}
+
+	names := make([]string, 0, len(server.Databases))
+	for name := range server.Databases {
+		if !authenticated && requireAuth(server, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	databases := make([]Database, 0, len(names))
+	for _, name := range names {
+		databases = append(databases, server.Databases[name])
+	}
+	return databases, nil
+}
+
+/* clientHandler implements CLIENT, which just records how the client
+ * identifies itself for logging. */
+func clientHandler(session *Session, command Command) {
+	if len(command.Params) < 1 {
+		WriteCode(session, 501, "Syntax error, illegal parameters")
+		return
+	}
+	session.Client = command.Params[0]
+	WriteCode(session, 250, "ok")
+}
+
+/* optionCommandHandler implements OPTION MIME, the only option this
+ * server understands. */
+func optionCommandHandler(session *Session, command Command) {
+	if len(command.Params) < 1 {
+		WriteCode(session, 501, "Syntax error, illegal parameters")
+		return
+	}
+
+	switch strings.ToUpper(command.Params[0]) {
+	case "MIME":
+		session.Options["MIME"] = true
+		WriteCode(session, 250, "ok")
+	default:
+		WriteCode(session, 501, "Syntax error, illegal parameters")
+	}
+}
+
+/* quitHandler implements QUIT. The session loop (see HandleTransport)
+ * is what actually ends the connection once this returns. */
+func quitHandler(session *Session, command Command) {
+	WriteCode(session, 221, "closing connection")
+}
+
+/* defineCommandHandler implements DEFINE database word. */
+func defineCommandHandler(session *Session, command Command) {
+	if len(command.Params) < 2 {
+		WriteCode(session, 501, "Syntax error, illegal parameters")
+		return
+	}
+
+	database := command.Params[0]
+	word := strings.Join(command.Params[1:], " ")
+
+	databases, err := candidateDatabases(session.DictServer, database, session.Authenticated)
+	if err != nil {
+		WriteCode(session, 550, "Invalid database, use SHOW DB for a list of databases")
+		return
+	}
+
+	var definitions []Definition
+	for _, db := range databases {
+		text, ok := db.Define(session.Ctx, word)
+		if !ok {
+			continue
+		}
+		definitions = append(definitions, Definition{Database: db, Text: text})
+		if database == "!" {
+			break
+		}
+	}
+	if len(definitions) == 0 {
+		WriteCode(session, 552, "No match")
+		return
+	}
+
+	WriteCode(session, 150, fmt.Sprintf("%d definitions retrieved", len(definitions)))
+	for _, definition := range definitions {
+		WriteCode(session, 151, fmt.Sprintf("%s %s %q", word, definition.Database.Name(), definition.Database.Description()))
+		WriteTextBlock(session, definition.Text)
+	}
+	WriteCode(session, 250, "ok")
+}
+
+/* matchCommandHandler implements MATCH database strategy word. */
+func matchCommandHandler(session *Session, command Command) {
+	if len(command.Params) < 3 {
+		WriteCode(session, 501, "Syntax error, illegal parameters")
+		return
+	}
+
+	database := command.Params[0]
+	strategy := command.Params[1]
+	word := strings.Join(command.Params[2:], " ")
+
+	databases, err := candidateDatabases(session.DictServer, database, session.Authenticated)
+	if err != nil {
+		WriteCode(session, 550, "Invalid database, use SHOW DB for a list of databases")
+		return
+	}
+
+	var lines []string
+	for _, db := range databases {
+		matches := db.Match(session.Ctx, strategy, word)
+		for _, headword := range matches {
+			lines = append(lines, fmt.Sprintf("%s %q", db.Name(), headword))
+		}
+		if database == "!" && len(matches) > 0 {
+			break
+		}
+	}
+	if len(lines) == 0 {
+		WriteCode(session, 552, "No match")
+		return
+	}
+
+	WriteCode(session, 152, fmt.Sprintf("%d matches found", len(lines)))
+	WriteTextBlock(session, strings.Join(lines, "\n"))
+	WriteCode(session, 250, "ok")
+}
+
+/* matchStrategies lists the MATCH strategies SHOW STRAT advertises;
+ * it's up to each Database.Match implementation to actually support
+ * them. */
+var matchStrategies = []struct{ Name, Description string }{
+	{"exact", "Match headwords exactly"},
+	{"prefix", "Match headwords by prefix"},
+}
+
+/* showCommandHandler implements the SHOW family: SHOW DB, SHOW STRAT,
+ * and SHOW INFO database. */
+func showCommandHandler(session *Session, command Command) {
+	if len(command.Params) < 1 {
+		WriteCode(session, 501, "Syntax error, illegal parameters")
+		return
+	}
+
+	switch strings.ToUpper(command.Params[0]) {
+	case "DB":
+		showDatabasesHandler(session)
+	case "STRAT":
+		showStrategiesHandler(session)
+	case "INFO":
+		if len(command.Params) < 2 {
+			WriteCode(session, 501, "Syntax error, illegal parameters")
+			return
+		}
+		showInfoHandler(session, command.Params[1])
+	default:
+		WriteCode(session, 501, "Syntax error, illegal parameters")
+	}
+}
+
+func showDatabasesHandler(session *Session) {
+	server := session.DictServer
+	if len(server.Databases) == 0 {
+		WriteCode(session, 554, "No databases present")
+		return
+	}
+
+	names := make([]string, 0, len(server.Databases))
+	for name := range server.Databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		db := server.Databases[name]
+		lines = append(lines, fmt.Sprintf("%s %q", db.Name(), db.Description()))
+	}
+
+	WriteCode(session, 110, fmt.Sprintf("%d databases present", len(lines)))
+	WriteTextBlock(session, strings.Join(lines, "\n"))
+	WriteCode(session, 250, "ok")
+}
+
+func showStrategiesHandler(session *Session) {
+	lines := make([]string, 0, len(matchStrategies))
+	for _, strategy := range matchStrategies {
+		lines = append(lines, fmt.Sprintf("%s %q", strategy.Name, strategy.Description))
+	}
+
+	WriteCode(session, 111, fmt.Sprintf("%d strategies present", len(lines)))
+	WriteTextBlock(session, strings.Join(lines, "\n"))
+	WriteCode(session, 250, "ok")
+}
+
+func showInfoHandler(session *Session, database string) {
+	db, ok := session.DictServer.Databases[database]
+	if !ok {
+		WriteCode(session, 550, "Invalid database, use SHOW DB for a list of databases")
+		return
+	}
+
+	WriteCode(session, 112, database+" information")
+	WriteTextBlock(session, db.Description())
+	WriteCode(session, 250, "ok")
+}
@@ -0,0 +1,101 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+/* countingMatchDatabase is a Database whose Match records how many
+ * times it was called, so a test can tell whether a later database in
+ * "!" order was consulted at all. */
+type countingMatchDatabase struct {
+	name    string
+	matches []string
+	calls   *int
+}
+
+func (d *countingMatchDatabase) Name() string        { return d.name }
+func (d *countingMatchDatabase) Description() string { return d.name }
+func (d *countingMatchDatabase) Define(ctx context.Context, word string) (string, bool) {
+	return "", false
+}
+func (d *countingMatchDatabase) Match(ctx context.Context, strategy, word string) []string {
+	*d.calls++
+	return d.matches
+}
+
+/* TestMatchBangStopsAtFirstHit exercises matchCommandHandler (not a
+ * hand-rolled fake server, see client_test.go, but the real server
+ * dispatching a real MATCH) to confirm "!" stops at the first database
+ * with a hit, the same as defineCommandHandler already does: "a" sorts
+ * before "b", so if the early exit is missing, "b"'s Match would also
+ * run and its headword would show up in the reply. */
+func TestMatchBangStopsAtFirstHit(t *testing.T) {
+	var aCalls, bCalls int
+	server := NewServer("test")
+	server.Databases["a"] = &countingMatchDatabase{name: "a", matches: []string{"hello"}, calls: &aCalls}
+	server.Databases["b"] = &countingMatchDatabase{name: "b", matches: []string{"help"}, calls: &bCalls}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	go serve(context.Background(), server, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	if _, err := text.ReadLine(); err != nil {
+		t.Fatalf("read banner: %v", err)
+	}
+	if err := text.PrintfLine("MATCH ! exact hello"); err != nil {
+		t.Fatalf("send MATCH: %v", err)
+	}
+
+	if line, err := text.ReadLine(); err != nil || line != "152 1 matches found" {
+		t.Fatalf("152 line = %q, %v; want 1 match (the early exit after \"a\")", line, err)
+	}
+	body, err := text.ReadDotBytes()
+	if err != nil || string(body) != "a \"hello\"\n" {
+		t.Fatalf("text block = %q, %v; want %q", body, err, `a "hello"`+"\n")
+	}
+	if line, err := text.ReadLine(); err != nil || line != "250 ok" {
+		t.Fatalf("250 line = %q, %v", line, err)
+	}
+
+	if aCalls != 1 {
+		t.Errorf("database \"a\" Match calls = %d, want 1", aCalls)
+	}
+	if bCalls != 0 {
+		t.Errorf("database \"b\" Match calls = %d, want 0 (never reached after \"!\" found a hit)", bCalls)
+	}
+}
@@ -0,0 +1,121 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+/* Package dictws serves the dict protocol over WebSocket, so a browser
+ * can speak to a dictd.Server without a separate TCP-to-WebSocket
+ * proxy. Each command and response line is framed as one WebSocket text
+ * message, except a text block (the body of a DEFINE, MATCH or SHOW
+ * reply), which goes out dot-stuffed and dot-terminated as a single
+ * message rather than one message per line. The
+ * command dispatcher itself doesn't know or care that it isn't reading
+ * off a raw TCP socket, since it only ever talks to a dictd.Transport. */
+package dictws
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/textproto"
+
+	"github.com/gorilla/websocket"
+	"github.com/ilius/go-dictd/dictd"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+/* transport adapts a *websocket.Conn to dictd.Transport, framing each
+ * line (or, for DotWriter, each whole text block) as one text
+ * message. */
+type transport struct {
+	ws *websocket.Conn
+}
+
+func (t *transport) ReadLine() (string, error) {
+	for {
+		kind, data, err := t.ws.ReadMessage()
+		if err != nil {
+			return "", err
+		}
+		if kind != websocket.TextMessage {
+			continue
+		}
+		return string(bytes.TrimRight(data, "\r\n")), nil
+	}
+}
+
+func (t *transport) PrintfLine(format string, args ...interface{}) error {
+	var buf bytes.Buffer
+	writer := textproto.NewWriter(bufio.NewWriter(&buf))
+	if err := writer.PrintfLine(format, args...); err != nil {
+		return err
+	}
+	return t.ws.WriteMessage(websocket.TextMessage, buf.Bytes())
+}
+
+func (t *transport) DotWriter() io.WriteCloser {
+	return &dotWriter{ws: t.ws, buf: &bytes.Buffer{}}
+}
+
+func (t *transport) Close() error {
+	return t.ws.Close()
+}
+
+/* dotWriter buffers a whole dot-encoded text block (reusing
+ * net/textproto's escaping rules) and ships it as a single WebSocket
+ * message once the block is complete. */
+type dotWriter struct {
+	ws    *websocket.Conn
+	buf   *bytes.Buffer
+	inner io.WriteCloser
+}
+
+func (d *dotWriter) Write(p []byte) (int, error) {
+	if d.inner == nil {
+		d.inner = textproto.NewWriter(bufio.NewWriter(d.buf)).DotWriter()
+	}
+	return d.inner.Write(p)
+}
+
+func (d *dotWriter) Close() error {
+	if d.inner != nil {
+		if err := d.inner.Close(); err != nil {
+			return err
+		}
+	}
+	return d.ws.WriteMessage(websocket.TextMessage, d.buf.Bytes())
+}
+
+/* Handler upgrades incoming HTTP requests to WebSocket connections and
+ * hands each one to server's shared session loop via
+ * dictd.HandleTransport, exactly as if it had arrived over raw TCP. */
+func Handler(server *dictd.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		dictd.HandleTransport(r.Context(), server, &transport{ws: ws}, nil)
+	})
+}
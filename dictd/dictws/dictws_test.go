@@ -0,0 +1,152 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/ilius/go-dictd/dictd"
+)
+
+/* stubDatabase is a minimal dictd.Database backing the round trips
+ * below: it always defines "hello" and matches "hello"/"help" under
+ * any strategy. */
+type stubDatabase struct{}
+
+func (stubDatabase) Name() string        { return "wn" }
+func (stubDatabase) Description() string { return "WordNet" }
+func (stubDatabase) Define(ctx context.Context, word string) (string, bool) {
+	if word != "hello" {
+		return "", false
+	}
+	return "a greeting", true
+}
+func (stubDatabase) Match(ctx context.Context, strategy, word string) []string {
+	return []string{"hello", "help"}
+}
+
+/* dialServer starts an httptest.Server with Handler mounted, upgrades
+ * to it via gorilla/websocket, and reads off the 220 banner so callers
+ * can start at the first command. */
+func dialServer(t *testing.T) *websocket.Conn {
+	t.Helper()
+
+	server := dictd.NewServer("test")
+	server.Databases["wn"] = stubDatabase{}
+
+	httpServer := httptest.NewServer(Handler(server))
+	t.Cleanup(httpServer.Close)
+
+	url := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/"
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatalf("read banner: %v", err)
+	}
+	return ws
+}
+
+func readLine(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+func sendLine(t *testing.T, ws *websocket.Conn, line string) {
+	t.Helper()
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+		t.Fatalf("write message %q: %v", line, err)
+	}
+}
+
+/* readTextBlock reads one WebSocket message and dot-decodes it: the
+ * server's dotWriter ships a whole DEFINE/MATCH text block, dot-stuffed
+ * per net/textproto, as a single message rather than one message per
+ * line. */
+func readTextBlock(t *testing.T, ws *websocket.Conn) string {
+	t.Helper()
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read message: %v", err)
+	}
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	body, err := reader.ReadDotBytes()
+	if err != nil {
+		t.Fatalf("decode text block %q: %v", data, err)
+	}
+	return strings.TrimRight(string(body), "\n")
+}
+
+/* TestDefineRoundTrip drives a full DEFINE over the WebSocket transport
+ * against a live dictd.Server, confirming the transport correctly
+ * frames both PrintfLine responses and the DotWriter text block as
+ * WebSocket text messages, and that ReadLine on the way in accepts a
+ * command sent as a bare text message with no line terminator. */
+func TestDefineRoundTrip(t *testing.T) {
+	ws := dialServer(t)
+
+	sendLine(t, ws, "DEFINE wn hello")
+
+	if got, want := readLine(t, ws), "150 1 definitions retrieved"; got != want {
+		t.Fatalf("line 1 = %q, want %q", got, want)
+	}
+	if got, want := readLine(t, ws), `151 hello wn "WordNet"`; got != want {
+		t.Fatalf("line 2 = %q, want %q", got, want)
+	}
+	if got, want := readTextBlock(t, ws), "a greeting"; got != want {
+		t.Fatalf("text block = %q, want %q", got, want)
+	}
+	if got, want := readLine(t, ws), "250 ok"; got != want {
+		t.Fatalf("line 4 = %q, want %q", got, want)
+	}
+}
+
+/* TestMatchRoundTrip drives a full MATCH over the same transport. */
+func TestMatchRoundTrip(t *testing.T) {
+	ws := dialServer(t)
+
+	sendLine(t, ws, "MATCH wn exact hello")
+
+	if got, want := readLine(t, ws), "152 2 matches found"; got != want {
+		t.Fatalf("line 1 = %q, want %q", got, want)
+	}
+	if got, want := readTextBlock(t, ws), "wn \"hello\"\nwn \"help\""; got != want {
+		t.Fatalf("text block = %q, want %q", got, want)
+	}
+	if got, want := readLine(t, ws), "250 ok"; got != want {
+		t.Fatalf("line 3 = %q, want %q", got, want)
+	}
+}
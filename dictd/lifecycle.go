@@ -0,0 +1,188 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* lifecycle.go - connection accounting and graceful shutdown for
+ * Server: the MaxConnections semaphore, the idle/command deadlines
+ * Handle applies per connection, and Shutdown, which stops taking new
+ * connections, tells in-flight ones to send 221 and close once their
+ * current command is done, and waits for them. */
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+/* serverLifecycle holds the bookkeeping behind Server.acquireConnSlot,
+ * Server.Shutdown, and friends. It's embedded in Server (zero value is
+ * ready to use, same as sync.Mutex). */
+type serverLifecycle struct {
+	once        sync.Once
+	mu          sync.Mutex
+	sem         chan struct{}
+	wg          sync.WaitGroup
+	listener    net.Listener
+	metrics     serverMetrics
+	closing     chan struct{}
+	closingOnce sync.Once
+}
+
+func (s *serverLifecycle) init(max int) {
+	s.once.Do(func() {
+		if max > 0 {
+			s.sem = make(chan struct{}, max)
+		}
+		s.closing = make(chan struct{})
+	})
+}
+
+/* acquireConnSlot reports whether the connection is allowed to proceed
+ * under Server.MaxConnections, registering it with the shutdown
+ * WaitGroup if so. Call releaseConnSlot when the connection ends. */
+func (server *Server) acquireConnSlot() bool {
+	server.lifecycle.init(server.MaxConnections)
+
+	if server.lifecycle.sem != nil {
+		select {
+		case server.lifecycle.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	server.lifecycle.wg.Add(1)
+
+	if m := server.metrics(); m != nil {
+		m.connectionsTotal.Inc()
+		m.activeConnections.Inc()
+	}
+	return true
+}
+
+/* releaseConnSlot releases the slot acquired by acquireConnSlot. */
+func (server *Server) releaseConnSlot() {
+	if server.lifecycle.sem != nil {
+		<-server.lifecycle.sem
+	}
+	server.lifecycle.wg.Done()
+
+	if m := server.metrics(); m != nil {
+		m.activeConnections.Dec()
+	}
+}
+
+/* shuttingDown returns a channel that's closed once Shutdown has been
+ * called, independently of ctx: ctx is whatever the caller of
+ * serve()/Handle passed in (commonly context.Background(), shared
+ * across every connection), so Shutdown can't rely on cancelling it.
+ * HandleTransport selects on this channel to know when to send the 221
+ * and close its transport. */
+func (server *Server) shuttingDown() <-chan struct{} {
+	server.lifecycle.init(server.MaxConnections)
+	return server.lifecycle.closing
+}
+
+/* idleDeadline returns the absolute time a connection's next ReadLine
+ * should give up by, or the zero Time if Server.IdleTimeout is unset. */
+func (server *Server) idleDeadline() time.Time {
+	if server.IdleTimeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(server.IdleTimeout)
+}
+
+/* commandContext derives a per-command context from the connection's
+ * context, bounded by Server.CommandTimeout when one is configured.
+ * The caller must call the returned cancel func once the command
+ * finishes. */
+func (server *Server) commandContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if server.CommandTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, server.CommandTimeout)
+}
+
+/* ListenAndServe listens on addr and serves plain-text dict
+ * connections, handing each one off to Handle. Call Server.Shutdown to
+ * stop it gracefully. */
+func ListenAndServe(ctx context.Context, server *Server, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, server, listener)
+}
+
+/* serve registers listener so Shutdown can close it, then Accepts
+ * connections until the listener closes (either because Shutdown was
+ * called, or because of a genuine error). */
+func serve(ctx context.Context, server *Server, listener net.Listener) error {
+	server.lifecycle.mu.Lock()
+	server.lifecycle.listener = listener
+	server.lifecycle.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go Handle(ctx, server, conn)
+	}
+}
+
+/* Shutdown stops the server from accepting new connections, signals
+ * every in-flight session to send its client a 221 closing message and
+ * close up (see shuttingDown, which HandleTransport selects on), and
+ * blocks until they've all finished doing so, or ctx is cancelled
+ * first, whichever comes first. It's safe to call Shutdown without a
+ * prior ListenAndServe if the server was only ever driven via Handle
+ * directly; in that case it just waits on whatever connections were
+ * registered through acquireConnSlot. */
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.lifecycle.mu.Lock()
+	listener := server.lifecycle.listener
+	server.lifecycle.listener = nil
+	server.lifecycle.mu.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	server.lifecycle.init(server.MaxConnections)
+	server.lifecycle.closingOnce.Do(func() {
+		close(server.lifecycle.closing)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		server.lifecycle.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,129 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+/* blockingDatabase is a Database whose Define blocks until release is
+ * closed, closing started first so a test can tell the handler is
+ * actually inside Define before it acts. */
+type blockingDatabase struct {
+	name    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDatabase) Name() string        { return d.name }
+func (d *blockingDatabase) Description() string { return d.name }
+func (d *blockingDatabase) Define(ctx context.Context, word string) (string, bool) {
+	close(d.started)
+	<-d.release
+	return "a slow greeting", true
+}
+func (d *blockingDatabase) Match(ctx context.Context, strategy, word string) []string {
+	return nil
+}
+
+/* TestShutdownWaitsForInFlightCommand reproduces the scenario the
+ * request calls out directly: a slow DEFINE in flight when Shutdown is
+ * called. The fix under test is that the shutdown watcher (see
+ * Session.cmdMu in socket.go) doesn't send 221/close until the DEFINE's
+ * whole 150/151/text/250 reply has gone out; without it, the client
+ * would see the closing message land in the middle of (or instead of)
+ * that reply. */
+func TestShutdownWaitsForInFlightCommand(t *testing.T) {
+	db := &blockingDatabase{name: "wn", started: make(chan struct{}), release: make(chan struct{})}
+	server := NewServer("test")
+	server.Databases["wn"] = db
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	go serve(context.Background(), server, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	if _, err := text.ReadLine(); err != nil {
+		t.Fatalf("read banner: %v", err)
+	}
+	if err := text.PrintfLine("DEFINE wn hello"); err != nil {
+		t.Fatalf("send DEFINE: %v", err)
+	}
+
+	select {
+	case <-db.started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("DEFINE never reached Database.Define")
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() { shutdownDone <- server.Shutdown(context.Background()) }()
+
+	/* Give Shutdown time to reach shuttingDown/cmdMu before releasing
+	 * the handler, so a broken fix (one that doesn't actually wait)
+	 * has a real chance to send 221 first. */
+	time.Sleep(100 * time.Millisecond)
+	close(db.release)
+
+	if line, err := text.ReadLine(); err != nil || line != "150 1 definitions retrieved" {
+		t.Fatalf("line 1 = %q, %v; want the 150", line, err)
+	}
+	if line, err := text.ReadLine(); err != nil || line != `151 hello wn "wn"` {
+		t.Fatalf("line 2 = %q, %v; want the 151", line, err)
+	}
+	body, err := text.ReadDotBytes()
+	if err != nil || string(body) != "a slow greeting\n" {
+		t.Fatalf("text block = %q, %v; want %q", body, err, "a slow greeting\n")
+	}
+	if line, err := text.ReadLine(); err != nil || line != "250 ok" {
+		t.Fatalf("line 4 = %q, %v; want the 250", line, err)
+	}
+	if line, err := text.ReadLine(); err != nil || line != "221 closing connection" {
+		t.Fatalf("line 5 = %q, %v; want the 221", line, err)
+	}
+	if _, err := text.ReadLine(); err == nil {
+		t.Fatal("expected the connection to be closed after 221")
+	}
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown never returned")
+	}
+}
@@ -0,0 +1,62 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* logging.go - structured logging for the session loop, replacing the
+ * old ad-hoc log.Printf calls with records a log aggregator can
+ * actually query on (msg_id, client, command, and so on). */
+
+import (
+	"context"
+	"log/slog"
+)
+
+/* Logger is the structured logging sink for a Server. *slog.Logger
+ * satisfies it directly, so the common case is just setting
+ * Server.Logger to a configured *slog.Logger (or leaving it nil, which
+ * falls back to slog.Default()). */
+type Logger interface {
+	Log(ctx context.Context, level slog.Level, msg string, args ...any)
+}
+
+/* logger returns server's configured Logger, or slog.Default() if none
+ * was set. */
+func (server *Server) logger() Logger {
+	if server.Logger != nil {
+		return server.Logger
+	}
+	return slog.Default()
+}
+
+/* logCommand emits one structured record per dispatched command. err is
+ * nil on the common path; it's set when the command couldn't be
+ * dispatched at all (e.g. no handler registered). */
+func logCommand(ctx context.Context, session *Session, command *Command, durationMs int64, err error) {
+	session.DictServer.logger().Log(ctx, slog.LevelInfo, "handled command",
+		"msg_id", session.MsgId,
+		"client", session.Client,
+		"command", command.Command,
+		"params_count", len(command.Params),
+		"duration_ms", durationMs,
+		"error", err,
+	)
+}
@@ -0,0 +1,80 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* metrics.go - optional Prometheus instrumentation. Nothing here does
+ * anything unless Server.Registerer is set: go-dictd shouldn't force a
+ * Prometheus dependency on anyone who doesn't ask for it. */
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* serverMetrics holds the collectors registered for a Server, built
+ * lazily the first time they're needed. */
+type serverMetrics struct {
+	once              sync.Once
+	commandsTotal     *prometheus.CounterVec
+	connectionsTotal  prometheus.Counter
+	activeConnections prometheus.Gauge
+	commandDuration   *prometheus.HistogramVec
+}
+
+func (m *serverMetrics) init(reg prometheus.Registerer) {
+	m.once.Do(func() {
+		m.commandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dictd_commands_total",
+			Help: "Total number of dict commands handled, by command and outcome.",
+		}, []string{"command", "status"})
+
+		m.connectionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dictd_connections_total",
+			Help: "Total number of connections accepted.",
+		})
+
+		m.activeConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dictd_active_connections",
+			Help: "Number of connections currently being served.",
+		})
+
+		m.commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "dictd_command_duration_seconds",
+			Help: "Time to dispatch and handle a dict command, by command.",
+		}, []string{"command"})
+
+		reg.MustRegister(m.commandsTotal, m.connectionsTotal, m.activeConnections, m.commandDuration)
+	})
+}
+
+/* metrics returns server's metrics collectors, initializing them
+ * against Server.Registerer on first use. It returns nil when
+ * Server.Registerer isn't set, and every call site treats a nil
+ * *serverMetrics as "metrics disabled". */
+func (server *Server) metrics() *serverMetrics {
+	if server.Registerer == nil {
+		return nil
+	}
+	server.lifecycle.metrics.init(server.Registerer)
+	return &server.lifecycle.metrics
+}
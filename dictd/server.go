@@ -0,0 +1,161 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* server.go - the Server type: a dict server's configuration, its
+ * registered databases, and the registry of command handlers
+ * handleCommand dispatches incoming commands to. */
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/* commandHandler is the signature every registered command handler
+ * must have; see Server.RegisterHandler. */
+type commandHandler func(session *Session, command Command)
+
+/* Command is a single parsed command line: its verb (upper-cased) and
+ * the whitespace/quote-delimited tokens that followed it. See
+ * parseLine. */
+type Command struct {
+	Command string
+	Params  []string
+}
+
+/* Database is implemented by a dict backend: something that can
+ * describe itself and look words up in itself. A Server's databases
+ * are looked up by name from Server.Databases; "*" and "!" are
+ * reserved by the protocol (search every database, search until the
+ * first hit) rather than naming an actual Database. */
+type Database interface {
+	/* Name is the short token clients pass as DEFINE/MATCH's database
+	 * argument. */
+	Name() string
+	/* Description is the free-text line SHOW DB lists next to Name. */
+	Description() string
+	/* Define looks word up verbatim, returning the entry's text block
+	 * and whether it was found. ctx is the command's context (see
+	 * Session.Ctx): a backend blocked on a slow network lookup should
+	 * select on ctx.Done() and give up once Server.CommandTimeout
+	 * elapses or the client disconnects, rather than running forever. */
+	Define(ctx context.Context, word string) (text string, ok bool)
+	/* Match looks word up under the given MATCH strategy, returning the
+	 * headwords it found. ctx is the command's context; see Define. */
+	Match(ctx context.Context, strategy, word string) []string
+}
+
+/* Definition is a single DEFINE result: which Database it came from,
+ * and the entry's text block. */
+type Definition struct {
+	Database Database
+	Text     string
+}
+
+/* Server holds a dict server's configuration: its name (used in the
+ * handshake banner and generateMsgId), its registered databases and
+ * command handlers, and the AUTH settings enforced by auth.go. Use
+ * NewServer to build one. */
+type Server struct {
+	Name      string
+	Databases map[string]Database
+
+	/* Authenticator, when set, enables the AUTH command: Lookup is
+	 * consulted for the shared secret behind each user AUTH names. A
+	 * nil Authenticator makes AUTH fail outright (see authHandler). */
+	Authenticator Authenticator
+	/* AuthMode selects how AUTH verifies a client's credentials. Zero
+	 * value is AuthDigest. */
+	AuthMode AuthMode
+	/* RestrictedDatabases lists databases that require a prior
+	 * successful AUTH to query (see requireAuth). A database absent
+	 * from this set (including when it's nil) is open to anonymous
+	 * clients. */
+	RestrictedDatabases map[string]bool
+
+	/* TLSConfig enables HandleTLS/ListenAndServeTLS and the STARTTLS
+	 * capability (see tls.go). Nil disables both, and the handshake
+	 * banner won't advertise "starttls". */
+	TLSConfig *tls.Config
+
+	/* MaxConnections caps the number of connections served at once via
+	 * acquireConnSlot/releaseConnSlot; zero (the default) means
+	 * unlimited. */
+	MaxConnections int
+	/* IdleTimeout bounds how long Handle will wait for a connection's
+	 * next command line before giving up on it; zero means no
+	 * deadline. */
+	IdleTimeout time.Duration
+	/* CommandTimeout bounds how long a single command's handler gets to
+	 * run, via the per-command context commandContext derives; zero
+	 * means no deadline. */
+	CommandTimeout time.Duration
+
+	/* Logger receives one structured record per dispatched command (see
+	 * logging.go); nil falls back to slog.Default(). */
+	Logger Logger
+	/* Registerer, when set, registers Prometheus collectors for the
+	 * session loop (see metrics.go); nil disables metrics entirely. */
+	Registerer prometheus.Registerer
+
+	handlers  map[string]commandHandler
+	lifecycle serverLifecycle
+}
+
+/* NewServer returns a Server named name, with the full built-in RFC
+ * 2229 command set registered (AUTH, STARTTLS, CLIENT, DEFINE, MATCH,
+ * SHOW, OPTION, QUIT) and no databases configured yet. name is used in
+ * the handshake banner and as the host part of generated message-ids. */
+func NewServer(name string) *Server {
+	server := &Server{
+		Name:      name,
+		Databases: map[string]Database{},
+		handlers:  map[string]commandHandler{},
+	}
+	server.RegisterHandler("AUTH", authHandler)
+	server.RegisterHandler("STARTTLS", startTLSHandler)
+	server.RegisterHandler("CLIENT", clientHandler)
+	server.RegisterHandler("DEFINE", defineCommandHandler)
+	server.RegisterHandler("MATCH", matchCommandHandler)
+	server.RegisterHandler("SHOW", showCommandHandler)
+	server.RegisterHandler("OPTION", optionCommandHandler)
+	server.RegisterHandler("QUIT", quitHandler)
+	return server
+}
+
+/* RegisterHandler registers handler to run whenever a client sends
+ * command (matched against the upper-cased verb; see parseLine).
+ * Registering under a verb that's already registered replaces the
+ * existing handler. */
+func (server *Server) RegisterHandler(command string, handler commandHandler) {
+	server.handlers[command] = handler
+}
+
+/* GetHandler returns the handler registered for command.Command, or
+ * nil if none is, in which case handleCommand falls back to
+ * unknownCommandHandler. */
+func (server *Server) GetHandler(command *Command) commandHandler {
+	return server.handlers[command.Command]
+}
@@ -28,12 +28,14 @@ package dictd
  * the incoming requests. */
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"log"
+	"log/slog"
 	"net"
-	"net/textproto"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -41,9 +43,79 @@ import (
 type Session struct {
 	MsgId      string
 	Client     string
-	Connection *textproto.Conn
-	DictServer *Server
-	Options    map[string]bool
+	Connection Transport
+	/* Conn is the underlying net.Conn, when the transport is backed by
+	 * one (plain TCP or TLS). It's nil for transports that aren't
+	 * net.Conn-shaped, such as dictws's WebSocket transport, in which
+	 * case the per-connection read/write deadlines Handle applies to
+	 * Conn simply don't apply. */
+	Conn          net.Conn
+	DictServer    *Server
+	Options       map[string]bool
+	Authenticated bool
+
+	/* Ctx is the context for the command currently being handled. It's
+	 * derived from the connection's context on each command (see
+	 * Handle) and carries Server.CommandTimeout, so long-running
+	 * handlers (e.g. network-backed dictionaries) can select on
+	 * Ctx.Done() and abandon work once the client gives up. */
+	Ctx context.Context
+
+	/* writeMu guards Connection, Conn, and every write that goes out
+	 * over them. HandleTransport's command loop isn't the only user of
+	 * Connection: the shutdown watcher goroutine it spawns writes the
+	 * closing 221 and closes the transport directly, and startTLSHandler
+	 * swaps Connection/Conn out mid-session for STARTTLS. Without a
+	 * shared lock, any pair of those can race on the underlying
+	 * bufio.Writer or on the fields themselves. Zero value is ready to
+	 * use. */
+	writeMu sync.Mutex
+
+	/* cmdMu is held by HandleTransport's loop for the full duration of
+	 * each handleCommand call, so the shutdown watcher goroutine can
+	 * block on it to find out when the command loop is actually idle.
+	 * Without this, the watcher's 221/close could land in the middle of
+	 * a handler's multi-line reply (each WriteCode/WriteTextBlock call
+	 * only holds writeMu for its own line), truncating it. Zero value is
+	 * ready to use. */
+	cmdMu sync.Mutex
+}
+
+/* writeLine writes a single response line to the session's current
+ * transport, serialized against any other writer of this session (see
+ * writeMu). Used by WriteCode and by HandleTransport's shutdown watcher. */
+func (session *Session) writeLine(format string, args ...interface{}) error {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	return session.Connection.PrintfLine(format, args...)
+}
+
+/* currentTransport returns the session's transport and underlying conn
+ * as of now, synchronized against a concurrent STARTTLS swap (see
+ * writeMu). HandleTransport's loop calls this every iteration instead
+ * of closing over its own transport/conn parameters. */
+func (session *Session) currentTransport() (Transport, net.Conn) {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	return session.Connection, session.Conn
+}
+
+/* setTransport swaps the session's Connection and Conn, synchronized
+ * against concurrent writes and reads (see writeMu). Used by
+ * startTLSHandler once the TLS handshake completes. */
+func (session *Session) setTransport(transport Transport, conn net.Conn) {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	session.Connection = transport
+	session.Conn = conn
+}
+
+/* closeTransport closes the session's current transport, synchronized
+ * against a concurrent STARTTLS swap (see writeMu). */
+func (session *Session) closeTransport() error {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	return session.Connection.Close()
 }
 
 func consumeAtom(buf string) (token string, buffer string, err error) {
@@ -56,27 +128,45 @@ func consumeAtom(buf string) (token string, buffer string, err error) {
 	return buf, "", nil
 }
 
+/* errUnterminatedString is returned by consumeString when the buffer
+ * runs out before the closing quote is found. */
+var errUnterminatedString = errors.New("dictd: unterminated quoted string")
+
+/* consumeString consumes a quoted token from buf, where quote is the
+ * single character (`"` or `'`) that opened it. Per RFC 2229 ยง2.1, only
+ * the matching outer quote and a backslash are special inside the
+ * string: `\\` unescapes to `\`, `\<quote>` unescapes to `<quote>`, and
+ * every other backslash sequence (e.g. `\n`) is left exactly as
+ * written. The other quote character is not special at all, so an
+ * unescaped `'` inside a double-quoted string (and vice versa) is just
+ * a literal character. */
 func consumeString(quote string, buf string) (token string, buffer string, err error) {
-	var escape = false
+	q := quote[0]
+	var out strings.Builder
+	escape := false
 
-	for i, el := range buf {
-		switch el {
-		case rune(quote[0]):
-			if !escape {
-				token := strings.Replace(buf[:i], "\\", "", -1)
-				return token, cleanup(buf[i+1:]), nil
+	for i := 0; i < len(buf); i++ {
+		c := buf[i]
+
+		if escape {
+			if c != q && c != '\\' {
+				out.WriteByte('\\')
 			}
+			out.WriteByte(c)
+			escape = false
+			continue
+		}
+
+		switch c {
 		case '\\':
 			escape = true
-			continue
-		case '\'', '"':
-			if !escape {
-				return "", "", errors.New("bad char")
-			}
+		case q:
+			return out.String(), cleanup(buf[i+1:]), nil
+		default:
+			out.WriteByte(c)
 		}
-		escape = false
 	}
-	return buf, "", nil
+	return "", "", errUnterminatedString
 }
 
 func cleanup(el string) string {
@@ -119,70 +209,190 @@ func parseLine(line string) (*Command, error) {
 }
 
 /* Given a dict.Session and a dict.Command, route the command to the proper
- * handler, and dispatch the command. */
-func handleCommand(session *Session, command *Command) {
-	log.Printf("Incomming command from %s: %s", session.MsgId, command.Command)
+ * handler, and dispatch the command. ctx is derived per-command (see
+ * Handle) so a handler backed by a slow network lookup can be
+ * cancelled without tearing down the whole connection.
+ *
+ * Every dispatch is logged through session.DictServer.Logger and, when
+ * Server.Registerer is set, recorded in the dictd_commands_total and
+ * dictd_command_duration_seconds metrics. */
+func handleCommand(ctx context.Context, session *Session, command *Command) {
+	session.Ctx = ctx
+
+	start := time.Now()
 	handler := session.DictServer.GetHandler(command)
-	if handler == nil {
+
+	var status string
+	var dispatchErr error
+	switch {
+	case handler == nil:
 		unknownCommandHandler(session, *command)
-	} else {
+		status = "unknown_command"
+		dispatchErr = errors.New("no handler registered for command")
+	case !authorizeCommand(session, command):
+		status = "access_denied"
+		dispatchErr = errors.New("database is restricted and session is not authenticated")
+	default:
 		handler(session, *command)
+		status = "ok"
+	}
+
+	duration := time.Since(start)
+	logCommand(ctx, session, command, duration.Milliseconds(), dispatchErr)
+
+	if m := session.DictServer.metrics(); m != nil {
+		m.commandsTotal.WithLabelValues(command.Command, status).Inc()
+		m.commandDuration.WithLabelValues(command.Command).Observe(duration.Seconds())
 	}
 }
 
 /* Helper for commands to write out a text block */
 func WriteTextBlock(session *Session, stream string) {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+
 	if session.Options["MIME"] {
-		session.Connection.Writer.PrintfLine(
+		session.Connection.PrintfLine(
 			"Content-type: text/plain; charset=utf-8\n" +
 				"Content-transfer-encoding: 8bit\n",
 		)
 
 	}
 
-	writer := session.Connection.Writer.DotWriter()
+	writer := session.Connection.DotWriter()
 	writer.Write([]byte(stream))
 	writer.Close()
 }
 
 /* Helper for commands to write out a code line */
 func WriteCode(session *Session, code int, message string) {
-	session.Connection.Writer.PrintfLine("%d %s", code, message)
+	session.writeLine("%d %s", code, message)
 }
 
 /* Helper to generate a "unique" Message ID for the client to use.
  *
- * It's not super vital, since we don't support AUTH yet. */
-func generateMsgId(server *Server) string {
-	return strconv.FormatInt(time.Now().UnixNano(), 10) +
-		".0@" +
-		server.Name
+ * AUTH relies on this being unpredictable (it's the nonce hashed
+ * together with the shared secret), so it's drawn from crypto/rand
+ * rather than the clock. Handle/HandleTransport run one goroutine per
+ * connection with no recover, so a rand.Read failure is returned to the
+ * caller to reject just that connection, rather than panicking and
+ * taking down the whole process. */
+func generateMsgId(server *Server) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "<" + hex.EncodeToString(buf) + "@" + server.Name + ">", nil
 }
 
 /* Given a `dict.Server` and a `net.Conn`, do a bringup, and run the
- * `ReadLine` loop, dispatching commands to the correct internals. */
-func Handle(server *Server, conn net.Conn) {
-	proto := textproto.NewConn(conn)
+ * `ReadLine` loop, dispatching commands to the correct internals. This
+ * is the plain-TCP (and TLS, since tls.Conn is a net.Conn too) entry
+ * point; transports that aren't net.Conn-shaped, such as dictws's
+ * WebSocket transport, call HandleTransport directly instead. */
+func Handle(ctx context.Context, server *Server, conn net.Conn) {
+	HandleTransport(ctx, server, newTextprotoTransport(conn), conn)
+}
+
+/* HandleTransport is the transport-agnostic core of Handle: it runs the
+ * bringup and `ReadLine` loop against any Transport, dispatching
+ * commands to the correct internals.
+ *
+ * ctx governs the whole connection: cancelling it closes the transport,
+ * which unblocks a pending ReadLine and ends the session. (Server.Shutdown
+ * doesn't cancel ctx; it is seen through server.shuttingDown.) Each
+ * individual command additionally gets its own context derived from
+ * ctx and bounded by Server.CommandTimeout, so one slow DEFINE can't
+ * wedge the connection forever.
+ *
+ * conn may be nil when transport isn't backed by a net.Conn; in that
+ * case the idle/command read and write deadlines Handle would
+ * otherwise apply are simply skipped, since Transport has no deadline
+ * concept of its own. */
+func HandleTransport(ctx context.Context, server *Server, transport Transport, conn net.Conn) {
+	if !server.acquireConnSlot() {
+		transport.PrintfLine("420 Too many connections, try again later")
+		transport.Close()
+		return
+	}
+	defer server.releaseConnSlot()
+	defer transport.Close()
+
+	msgId, err := generateMsgId(server)
+	if err != nil {
+		server.logger().Log(ctx, slog.LevelError, "failed to generate message id",
+			"error", err)
+		transport.PrintfLine("420 Server error, try again later")
+		return
+	}
 
 	session := Session{
-		MsgId:      generateMsgId(server),
+		MsgId:      msgId,
 		Client:     "",
-		Connection: proto,
+		Connection: transport,
+		Conn:       conn,
 		DictServer: server,
 		Options:    map[string]bool{},
+		Ctx:        ctx,
 	}
 
 	session.Options["MIME"] = false /* Requiredish */
 
+	/* done is closed when this connection's loop returns (for any
+	 * reason), so the watcher goroutine below always exits along with
+	 * it instead of leaking for the remaining lifetime of the process:
+	 * ctx is shared across every connection serve() accepts, so
+	 * ctx.Done() alone won't fire until the whole server shuts down.
+	 *
+	 * server.shuttingDown() is separate from ctx: it's what actually
+	 * fires when Shutdown is called, and unlike bare cancellation it
+	 * gets a 221 out to the client first, so Shutdown's "graceful"
+	 * promise is met instead of just abandoning the socket. */
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.closeTransport()
+		case <-server.shuttingDown():
+			/* Wait for whatever command is currently in flight to
+			 * finish its whole reply before sending 221/closing (see
+			 * Session.cmdMu), so this can't truncate or interleave with
+			 * it. Goes through session.writeLine/closeTransport, not a
+			 * bare PrintfLine/Close, so it also can't race a STARTTLS
+			 * swap against the command loop (see Session.writeMu). */
+			session.cmdMu.Lock()
+			session.writeLine("221 closing connection")
+			session.closeTransport()
+			session.cmdMu.Unlock()
+		case <-done:
+		}
+	}()
+
 	/* Right, so we've got a connection, let's send the 220 and let the
 	 * client know we're happy. */
 	handshakeHandler(&session)
 
 	for {
-		line, err := proto.ReadLine()
+		/* Re-fetch the session's transport/conn every iteration rather
+		 * than closing over the transport/conn parameters: startTLSHandler
+		 * swaps both out from under a successful STARTTLS, and this loop
+		 * needs to read from (and apply deadlines to) whatever is
+		 * current, not whatever bringup started with. */
+		currentTransport, currentConn := session.currentTransport()
+
+		if currentConn != nil {
+			if deadline := server.idleDeadline(); !deadline.IsZero() {
+				currentConn.SetReadDeadline(deadline)
+			}
+		}
+
+		line, err := currentTransport.ReadLine()
 		if err != nil {
-			log.Printf("Error: %s", err)
-			/* Usually an EOF */
+			/* Usually an EOF, a closed conn, or an idle timeout */
+			server.logger().Log(ctx, slog.LevelInfo, "connection closed",
+				"msg_id", session.MsgId, "client", session.Client, "error", err)
 			return
 		}
 
@@ -193,9 +403,27 @@ func Handle(server *Server, conn net.Conn) {
 
 		command, err := parseLine(line)
 		if err != nil {
-			log.Printf("Error: %s", err)
+			server.logger().Log(ctx, slog.LevelWarn, "failed to parse command line",
+				"msg_id", session.MsgId, "client", session.Client, "error", err)
 			continue
 		}
-		handleCommand(&session, command)
+
+		cmdCtx, cancel := server.commandContext(ctx)
+		if currentConn != nil {
+			if deadline, ok := cmdCtx.Deadline(); ok {
+				currentConn.SetWriteDeadline(deadline)
+			}
+		}
+		/* Held for the whole dispatch, not just one write, so the
+		 * shutdown watcher (see Session.cmdMu) can't send 221/close in
+		 * the middle of a multi-line reply. */
+		session.cmdMu.Lock()
+		handleCommand(cmdCtx, &session, command)
+		session.cmdMu.Unlock()
+		cancel()
+
+		if command.Command == "QUIT" {
+			return
+		}
 	}
 }
@@ -0,0 +1,104 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConsumeString(t *testing.T) {
+	cases := []struct {
+		name      string
+		quote     string
+		buf       string
+		wantToken string
+		wantRest  string
+		wantErr   error
+	}{
+		{
+			name:      "escaped double quote",
+			quote:     `"`,
+			buf:       `a\"b"`,
+			wantToken: `a"b`,
+		},
+		{
+			name:      "escaped single quote",
+			quote:     `'`,
+			buf:       `it\'s'`,
+			wantToken: `it's`,
+		},
+		{
+			name:      "escaped backslash",
+			quote:     `"`,
+			buf:       `c:\\path"`,
+			wantToken: `c:\path`,
+		},
+		{
+			name:      "unescaped opposite quote is literal",
+			quote:     `"`,
+			buf:       `it's fine"`,
+			wantToken: `it's fine`,
+		},
+		{
+			name:      "other backslash sequences are left intact",
+			quote:     `"`,
+			buf:       `a\nb"`,
+			wantToken: `a\nb`,
+		},
+		{
+			name:      "trailing buffer is preserved after the closing quote",
+			quote:     `"`,
+			buf:       `word" rest`,
+			wantToken: `word`,
+			wantRest:  `rest`,
+		},
+		{
+			name:    "unterminated string",
+			quote:   `"`,
+			buf:     `no closing quote here`,
+			wantErr: errUnterminatedString,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			token, rest, err := consumeString(tc.quote, tc.buf)
+
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("consumeString(%q, %q) err = %v, want %v", tc.quote, tc.buf, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("consumeString(%q, %q) unexpected err: %v", tc.quote, tc.buf, err)
+			}
+			if token != tc.wantToken {
+				t.Errorf("consumeString(%q, %q) token = %q, want %q", tc.quote, tc.buf, token, tc.wantToken)
+			}
+			if rest != tc.wantRest {
+				t.Errorf("consumeString(%q, %q) rest = %q, want %q", tc.quote, tc.buf, rest, tc.wantRest)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* tls.go - implicit TLS and STARTTLS support.
+ *
+ * A Server can be run on a port that's TLS from the first byte
+ * (HandleTLS/ListenAndServeTLS), or it can accept plain connections and
+ * let the client upgrade mid-session with STARTTLS. Either way, once
+ * TLS is in place the rest of the session loop doesn't know the
+ * difference: it's still just reading lines off session.Connection. */
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+)
+
+/* ListenAndServeTLS listens on addr and serves dict-over-TLS
+ * connections, handing each one off to Handle as soon as it's accepted;
+ * the TLS handshake runs on the connection's first read or write.
+ * Server.TLSConfig must be set. Call Server.Shutdown to stop it
+ * gracefully. */
+func ListenAndServeTLS(ctx context.Context, server *Server, addr string) error {
+	listener, err := tls.Listen("tcp", addr, server.TLSConfig)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, server, listener)
+}
+
+/* HandleTLS wraps conn in a TLS server connection using
+ * Server.TLSConfig and hands it to Handle. It's the building block
+ * ListenAndServeTLS is written on top of, exposed for callers that want
+ * to manage their own listener. */
+func HandleTLS(ctx context.Context, server *Server, conn net.Conn) {
+	Handle(ctx, server, tls.Server(conn, server.TLSConfig))
+}
+
+/* startTLSHandler implements the STARTTLS capability: on success, it
+ * swaps session.Connection for one wrapping a TLS connection over the
+ * same socket, clears any options negotiated so far (the client is
+ * expected to renegotiate them over the now-private channel), and
+ * re-issues the banner as RFC 2229 ยง2.4.10 dictates. */
+func startTLSHandler(session *Session, command Command) {
+	server := session.DictServer
+	if server.TLSConfig == nil {
+		WriteCode(session, 502, "Command not implemented")
+		return
+	}
+
+	if session.Conn == nil {
+		WriteCode(session, 420, "Server error, STARTTLS not available on this transport")
+		return
+	}
+
+	WriteCode(session, 580, "Begin TLS negotiation now")
+
+	tlsConn := tls.Server(session.Conn, server.TLSConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		/* The handshake already consumed bytes off the wire, so the
+		 * connection can't be trusted to fall back to plaintext: close
+		 * it outright rather than leaving it half-negotiated and
+		 * silently hung. */
+		server.logger().Log(session.Ctx, slog.LevelWarn, "STARTTLS handshake failed",
+			"msg_id", session.MsgId, "client", session.Client, "error", err)
+		session.closeTransport()
+		return
+	}
+
+	session.setTransport(newTextprotoTransport(tlsConn), tlsConn)
+	session.Options = map[string]bool{"MIME": false}
+
+	handshakeHandler(session)
+}
+
+/* tlsCapability returns the capability string to advertise in the
+ * handshake banner (see handshakeHandler), or "" when the server has
+ * no TLSConfig and STARTTLS isn't available. */
+func tlsCapability(server *Server) string {
+	if server.TLSConfig == nil {
+		return ""
+	}
+	return "starttls"
+}
@@ -0,0 +1,153 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* selfSignedTLSConfig returns a *tls.Config good for exactly one test:
+ * a fresh, unpinned self-signed cert for "127.0.0.1". */
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+/* TestStartTLSSwapsTransport drives a real STARTTLS negotiation end to
+ * end against a live Server: plain handshake, STARTTLS, a TLS
+ * handshake over the same socket, then a DEFINE sent over the
+ * now-encrypted connection. This is the transport swap startTLSHandler
+ * performs (see tls.go): session.Connection/Conn are replaced with a
+ * transport wrapping the tls.Conn, so everything after STARTTLS must
+ * keep working against the new transport, not the original plain one. */
+func TestStartTLSSwapsTransport(t *testing.T) {
+	server := NewServer("test")
+	server.TLSConfig = selfSignedTLSConfig(t)
+	server.Databases["wn"] = stubTextDatabase{name: "wn", text: "hello there"}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	go serve(context.Background(), server, listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	banner, err := text.ReadLine()
+	if err != nil {
+		t.Fatalf("read banner: %v", err)
+	}
+	if !strings.Contains(banner, "starttls") {
+		t.Fatalf("banner %q doesn't advertise starttls", banner)
+	}
+
+	if err := text.PrintfLine("STARTTLS"); err != nil {
+		t.Fatalf("send STARTTLS: %v", err)
+	}
+	if line, err := text.ReadLine(); err != nil || line != "580 Begin TLS negotiation now" {
+		t.Fatalf("STARTTLS reply = %q, %v", line, err)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	tlsText := textproto.NewConn(tlsConn)
+
+	if _, err := tlsText.ReadLine(); err != nil {
+		t.Fatalf("read post-STARTTLS banner: %v", err)
+	}
+
+	if err := tlsText.PrintfLine("DEFINE wn hello"); err != nil {
+		t.Fatalf("send DEFINE over TLS: %v", err)
+	}
+	if line, err := tlsText.ReadLine(); err != nil || line != "150 1 definitions retrieved" {
+		t.Fatalf("150 line = %q, %v", line, err)
+	}
+	if _, err := tlsText.ReadLine(); err != nil { // 151
+		t.Fatalf("151 line: %v", err)
+	}
+	body, err := tlsText.ReadDotBytes()
+	if err != nil || string(body) != "hello there\n" {
+		t.Fatalf("text block = %q, %v; want %q", body, err, "hello there\n")
+	}
+	if line, err := tlsText.ReadLine(); err != nil || line != "250 ok" {
+		t.Fatalf("250 line = %q, %v", line, err)
+	}
+}
+
+/* stubTextDatabase is a Database that always defines word as text. */
+type stubTextDatabase struct {
+	name string
+	text string
+}
+
+func (d stubTextDatabase) Name() string        { return d.name }
+func (d stubTextDatabase) Description() string { return d.name }
+func (d stubTextDatabase) Define(ctx context.Context, word string) (string, bool) {
+	return d.text, true
+}
+func (d stubTextDatabase) Match(ctx context.Context, strategy, word string) []string {
+	return nil
+}
@@ -0,0 +1,79 @@
+/**
+ * Copyright (c) Paul R. Tagliamonte, 2015
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in
+ * all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING
+ * FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER
+ * DEALINGS IN THE SOFTWARE. */
+
+package dictd
+
+/* transport.go - pulls the line-oriented protocol out of net/textproto
+ * specifically, so the same command dispatcher can run over any
+ * transport that can read a line, write a line, and write a dot-block:
+ * raw TCP, WebSocket (see the dictws subpackage), or anything else. */
+
+import (
+	"io"
+	"net/textproto"
+)
+
+/* Transport is everything the session loop and the command handlers
+ * need from the underlying connection. Session.Connection holds one of
+ * these instead of a concrete *textproto.Conn. */
+type Transport interface {
+	/* ReadLine reads a single logical line (a command, stripped of its
+	 * terminator). */
+	ReadLine() (string, error)
+	/* PrintfLine formats and writes a single logical line, appending
+	 * the transport's own terminator. */
+	PrintfLine(format string, args ...interface{}) error
+	/* DotWriter returns a writer that dot-stuffs and terminates a text
+	 * block (an RFC 2229 "text block", as used by DEFINE/SHOW INFO);
+	 * the block is flushed when the writer is closed. */
+	DotWriter() io.WriteCloser
+	/* Close closes the transport. */
+	Close() error
+}
+
+/* textprotoTransport adapts a *textproto.Conn, the transport the
+ * server has always used for plain TCP (and TLS, which is just TCP
+ * wrapped in a tls.Conn), to the Transport interface. */
+type textprotoTransport struct {
+	conn *textproto.Conn
+}
+
+/* newTextprotoTransport wraps conn (already a net.Conn, plain or TLS)
+ * in the net/textproto based Transport implementation. */
+func newTextprotoTransport(conn io.ReadWriteCloser) Transport {
+	return &textprotoTransport{conn: textproto.NewConn(conn)}
+}
+
+func (t *textprotoTransport) ReadLine() (string, error) {
+	return t.conn.Reader.ReadLine()
+}
+
+func (t *textprotoTransport) PrintfLine(format string, args ...interface{}) error {
+	return t.conn.Writer.PrintfLine(format, args...)
+}
+
+func (t *textprotoTransport) DotWriter() io.WriteCloser {
+	return t.conn.Writer.DotWriter()
+}
+
+func (t *textprotoTransport) Close() error {
+	return t.conn.Close()
+}